@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// AuthProvider lets a forum accept logins from somewhere other than
+// Twitter without UserName/MakeInternalUserName growing another
+// hardcoded prefix. Each provider registers under a short prefix (e.g.
+// "gh" for GitHub); UserNameInternal values it produces are always
+// "<prefix>:<subject>", never an email address or anything else that
+// could change or leak PII.
+type AuthProvider interface {
+	// Prefix is the short string stored before the ':' in
+	// UserNameInternal for users authenticated by this provider.
+	Prefix() string
+	// DisplayName returns the human-readable name to show for
+	// userNameInternal, a value this provider previously produced.
+	DisplayName(userNameInternal string) string
+	// Authenticate verifies r (e.g. an OAuth2 callback request) and
+	// returns the UserNameInternal to record for the resulting post.
+	Authenticate(r *http.Request) (userNameInternal string, err error)
+}
+
+var authProviders = make(map[string]AuthProvider)
+
+// RegisterAuthProvider makes an AuthProvider available under its
+// Prefix(). The providers in auth_providers.go don't register
+// themselves: the caller constructs each with its client credentials
+// and registers it. The registry isn't locked, so registration has to
+// finish before requests are served; registering two providers under
+// the same prefix is a programming error.
+func RegisterAuthProvider(p AuthProvider) {
+	prefix := p.Prefix()
+	if _, dup := authProviders[prefix]; dup {
+		panic(fmt.Sprintf("RegisterAuthProvider: duplicate prefix %q", prefix))
+	}
+	authProviders[prefix] = p
+}
+
+// authProviderFor returns the AuthProvider that produced
+// userNameInternal, or nil if its prefix isn't registered (e.g. it
+// predates the registry, or its provider isn't configured in this
+// process).
+func authProviderFor(userNameInternal string) AuthProvider {
+	idx := strings.IndexByte(userNameInternal, ':')
+	if idx == -1 {
+		return nil
+	}
+	return authProviders[userNameInternal[:idx]]
+}
+
+// ResolvePostingIdentity is the hook new-topic/new-post handlers should
+// call before accepting a post: it tries every registered provider in
+// turn and returns the first successful UserNameInternal. There's no
+// handler/main package in this snapshot to call it from; a real one
+// would reject the request (rather than fall back to an anonymous
+// name) when every provider's Authenticate returns an error.
+func ResolvePostingIdentity(r *http.Request) (userNameInternal string, err error) {
+	var lastErr error
+	for _, p := range authProviders {
+		userNameInternal, lastErr = p.Authenticate(r)
+		if lastErr == nil {
+			return userNameInternal, nil
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("ResolvePostingIdentity: no auth providers registered")
+	}
+	return "", lastErr
+}
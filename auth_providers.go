@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/github"
+	"golang.org/x/oauth2/google"
+)
+
+// GitHubAuthProvider authenticates via GitHub's OAuth2 flow, using the
+// numeric GitHub user id (stable even across username changes) as the
+// subject.
+type GitHubAuthProvider struct {
+	config *oauth2.Config
+}
+
+// NewGitHubAuthProvider creates a provider registered for the "gh"
+// prefix; call RegisterAuthProvider(p) to make it available.
+func NewGitHubAuthProvider(clientID, clientSecret, redirectURL string) *GitHubAuthProvider {
+	return &GitHubAuthProvider{
+		config: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Scopes:       []string{"read:user"},
+			Endpoint:     github.Endpoint,
+		},
+	}
+}
+
+func (p *GitHubAuthProvider) Prefix() string { return "gh" }
+
+// DisplayName only formats the raw internal name; Post.UserName checks
+// a store-scoped override before ever calling this, so there's nothing
+// to override here.
+func (p *GitHubAuthProvider) DisplayName(userNameInternal string) string {
+	return "GitHub user " + userNameInternal[len(p.Prefix())+1:]
+}
+
+func (p *GitHubAuthProvider) Authenticate(r *http.Request) (string, error) {
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		return "", errors.New("GitHubAuthProvider.Authenticate: missing OAuth2 code")
+	}
+	ctx := r.Context()
+	token, err := p.config.Exchange(ctx, code)
+	if err != nil {
+		return "", fmt.Errorf("GitHubAuthProvider.Authenticate: token exchange failed: %w", err)
+	}
+	// unlike the OIDC providers below, GitHub's classic OAuth2 flow has
+	// no id_token; the access token is itself the thing to trust, and we
+	// use it to ask GitHub's API who it belongs to
+	subject, err := fetchGitHubUserID(ctx, p.config.Client(ctx, token))
+	if err != nil {
+		return "", err
+	}
+	return p.Prefix() + ":" + subject, nil
+}
+
+func fetchGitHubUserID(ctx context.Context, client *http.Client) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://api.github.com/user", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("fetchGitHubUserID: request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetchGitHubUserID: GitHub API returned %s", resp.Status)
+	}
+	var body struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("fetchGitHubUserID: decoding response failed: %w", err)
+	}
+	return strconv.FormatInt(body.ID, 10), nil
+}
+
+// GoogleAuthProvider authenticates via Google's OAuth2/OIDC flow, using
+// the ID token's verified "sub" claim (never the email) as the
+// subject.
+type GoogleAuthProvider struct {
+	config   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewGoogleAuthProvider creates a provider registered for the "g"
+// prefix; call RegisterAuthProvider(p) to make it available. It fetches
+// Google's OIDC discovery document, so it needs a context and can fail.
+func NewGoogleAuthProvider(ctx context.Context, clientID, clientSecret, redirectURL string) (*GoogleAuthProvider, error) {
+	provider, err := oidc.NewProvider(ctx, "https://accounts.google.com")
+	if err != nil {
+		return nil, fmt.Errorf("NewGoogleAuthProvider: fetching discovery document failed: %w", err)
+	}
+	return &GoogleAuthProvider{
+		config: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Scopes:       []string{oidc.ScopeOpenID},
+			Endpoint:     google.Endpoint,
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+	}, nil
+}
+
+func (p *GoogleAuthProvider) Prefix() string { return "g" }
+
+// DisplayName only formats the raw internal name; Post.UserName checks
+// a store-scoped override before ever calling this, so there's nothing
+// to override here.
+func (p *GoogleAuthProvider) DisplayName(userNameInternal string) string {
+	return "Google user " + userNameInternal[len(p.Prefix())+1:]
+}
+
+func (p *GoogleAuthProvider) Authenticate(r *http.Request) (string, error) {
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		return "", errors.New("GoogleAuthProvider.Authenticate: missing OAuth2 code")
+	}
+	ctx := r.Context()
+	token, err := p.config.Exchange(ctx, code)
+	if err != nil {
+		return "", fmt.Errorf("GoogleAuthProvider.Authenticate: token exchange failed: %w", err)
+	}
+	subject, err := verifiedSubject(ctx, token, p.verifier)
+	if err != nil {
+		return "", fmt.Errorf("GoogleAuthProvider.Authenticate: %w", err)
+	}
+	return p.Prefix() + ":" + subject, nil
+}
+
+// OIDCAuthProvider authenticates against any generic OpenID Connect
+// issuer (Okta, Auth0, a self-hosted Keycloak, ...), again keying off
+// the ID token's verified "sub" claim.
+type OIDCAuthProvider struct {
+	prefix   string
+	config   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDCAuthProvider creates a provider registered under prefix, which
+// the caller picks per-issuer (e.g. "oidc-okta") since there can be
+// more than one OIDC issuer configured at once; call
+// RegisterAuthProvider(p) to make it available. It fetches issuer's
+// OIDC discovery document, so it needs a context and can fail.
+func NewOIDCAuthProvider(ctx context.Context, prefix, issuer, clientID, clientSecret, redirectURL string) (*OIDCAuthProvider, error) {
+	provider, err := oidc.NewProvider(ctx, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("NewOIDCAuthProvider(%s): fetching discovery document failed: %w", prefix, err)
+	}
+	return &OIDCAuthProvider{
+		prefix: prefix,
+		config: &oauth2.Config{
+			ClientID:     clientID,
+			ClientSecret: clientSecret,
+			RedirectURL:  redirectURL,
+			Scopes:       []string{oidc.ScopeOpenID},
+			Endpoint:     provider.Endpoint(),
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: clientID}),
+	}, nil
+}
+
+func (p *OIDCAuthProvider) Prefix() string { return p.prefix }
+
+// DisplayName only formats the raw internal name; Post.UserName checks
+// a store-scoped override before ever calling this, so there's nothing
+// to override here.
+func (p *OIDCAuthProvider) DisplayName(userNameInternal string) string {
+	return userNameInternal[len(p.prefix)+1:]
+}
+
+func (p *OIDCAuthProvider) Authenticate(r *http.Request) (string, error) {
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		return "", fmt.Errorf("OIDCAuthProvider(%s).Authenticate: missing OAuth2 code", p.prefix)
+	}
+	ctx := r.Context()
+	token, err := p.config.Exchange(ctx, code)
+	if err != nil {
+		return "", fmt.Errorf("OIDCAuthProvider(%s).Authenticate: token exchange failed: %w", p.prefix, err)
+	}
+	subject, err := verifiedSubject(ctx, token, p.verifier)
+	if err != nil {
+		return "", fmt.Errorf("OIDCAuthProvider(%s).Authenticate: %w", p.prefix, err)
+	}
+	return p.prefix + ":" + subject, nil
+}
+
+// verifiedSubject extracts the "sub" claim from the id_token that
+// accompanies an OIDC token exchange, after verifying its signature
+// against the issuer's published JWKS and checking its audience and
+// issuer match verifier's configuration (oidc.IDTokenVerifier.Verify
+// does all of this; we never trust an id_token's claims before it
+// returns successfully).
+func verifiedSubject(ctx context.Context, token *oauth2.Token, verifier *oidc.IDTokenVerifier) (string, error) {
+	raw, ok := token.Extra("id_token").(string)
+	if !ok || raw == "" {
+		return "", errors.New("token response had no id_token")
+	}
+	idToken, err := verifier.Verify(ctx, raw)
+	if err != nil {
+		return "", fmt.Errorf("id_token failed verification: %w", err)
+	}
+	var claims struct {
+		Sub string `json:"sub"`
+	}
+	if err := idToken.Claims(&claims); err != nil {
+		return "", fmt.Errorf("malformed id_token claims: %w", err)
+	}
+	if claims.Sub == "" {
+		return "", errors.New("id_token had no sub claim")
+	}
+	return claims.Sub, nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kjk/u"
+)
+
+// fsMessageStoreMaxFiles bounds how many shard files we keep open at
+// once, so a busy forum with messages spread across many topics and
+// days doesn't exhaust file descriptors.
+const fsMessageStoreMaxFiles = 64
+
+// fileMessageID locates a message in the sharded log: which topic,
+// which day's shard file, and the byte offset of the line within it.
+// Unlike a topic/post id it never changes once written, so it's safe
+// to hand out in URLs, RSS <guid> elements, and moderation logs.
+type fileMessageID struct {
+	TopicID int
+	Date    time.Time // truncated to the day
+	Offset  int64
+}
+
+// String encodes the id as the opaque "m<topic>.<yyyymmdd>.<offset>"
+// form returned by Store.MessageIDFor.
+func (id fileMessageID) String() string {
+	y, m, d := id.Date.Date()
+	return fmt.Sprintf("m%d.%04d%02d%02d.%d", id.TopicID, y, m, d, id.Offset)
+}
+
+func parseFileMessageID(s string) (fileMessageID, error) {
+	var id fileMessageID
+	if !strings.HasPrefix(s, "m") {
+		return id, errors.New("not a sharded message id")
+	}
+	parts := strings.Split(s[1:], ".")
+	if len(parts) != 3 || len(parts[1]) != 8 {
+		return id, errors.New("malformed message id")
+	}
+	topicID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return id, fmt.Errorf("malformed message id: %w", err)
+	}
+	year, err1 := strconv.Atoi(parts[1][:4])
+	month, err2 := strconv.Atoi(parts[1][4:6])
+	day, err3 := strconv.Atoi(parts[1][6:8])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return id, errors.New("malformed message id: bad date")
+	}
+	offset, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return id, fmt.Errorf("malformed message id: %w", err)
+	}
+	id.TopicID = topicID
+	id.Date = time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)
+	id.Offset = offset
+	return id, nil
+}
+
+func shardPath(dataDir, forumName string, topicID int, date time.Time) string {
+	y, m, d := date.Date()
+	return filepath.Join(dataDir, "forum", forumName, strconv.Itoa(topicID),
+		fmt.Sprintf("%04d", y), fmt.Sprintf("%02d", m), fmt.Sprintf("%02d.log", d))
+}
+
+type openShard struct {
+	path string
+	f    *os.File
+}
+
+// fileMessageStore is an LRU-bounded cache of open shard file handles,
+// keyed by path, shared by readers and the (single) writer. Evicting
+// the least-recently-used handle just closes the *os.File; the data on
+// disk is untouched.
+type fileMessageStore struct {
+	sync.Mutex
+	maxOpen int
+	order   *list.List // front = most recently used
+	byPath  map[string]*list.Element
+}
+
+func newFileMessageStore(maxOpen int) *fileMessageStore {
+	return &fileMessageStore{
+		maxOpen: maxOpen,
+		order:   list.New(),
+		byPath:  make(map[string]*list.Element),
+	}
+}
+
+func (s *fileMessageStore) get(path string) (*os.File, error) {
+	s.Lock()
+	defer s.Unlock()
+	if el, ok := s.byPath[path]; ok {
+		s.order.MoveToFront(el)
+		return el.Value.(*openShard).f, nil
+	}
+	if err := u.CreateDirForFile(path); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	el := s.order.PushFront(&openShard{path: path, f: f})
+	s.byPath[path] = el
+	for s.order.Len() > s.maxOpen {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		shard := oldest.Value.(*openShard)
+		delete(s.byPath, shard.path)
+		shard.f.Close()
+	}
+	return f, nil
+}
+
+func (s *fileMessageStore) closeAll() error {
+	s.Lock()
+	defer s.Unlock()
+	var firstErr error
+	for el := s.order.Front(); el != nil; el = el.Next() {
+		if err := el.Value.(*openShard).f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.order.Init()
+	s.byPath = make(map[string]*list.Element)
+	return firstErr
+}
+
+// writeMessage appends msg to today's shard file for topicID, returning
+// the id under which it can later be retrieved with readMessage.
+func (s *fileMessageStore) writeMessage(dataDir, forumName string, topicID int, msg []byte) (fileMessageID, error) {
+	now := time.Now().UTC()
+	date := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	path := shardPath(dataDir, forumName, topicID, date)
+	f, err := s.get(path)
+	if err != nil {
+		return fileMessageID{}, err
+	}
+	offset, err := f.Seek(0, os.SEEK_END)
+	if err != nil {
+		return fileMessageID{}, err
+	}
+	line := fmt.Sprintf("%d %s\n", offset, base64.StdEncoding.EncodeToString(msg))
+	if _, err := f.WriteString(line); err != nil {
+		return fileMessageID{}, err
+	}
+	return fileMessageID{TopicID: topicID, Date: date, Offset: offset}, nil
+}
+
+// readMessage reads back a message previously written by writeMessage.
+func (s *fileMessageStore) readMessage(dataDir, forumName string, id fileMessageID) ([]byte, error) {
+	path := shardPath(dataDir, forumName, id.TopicID, id.Date)
+	f, err := s.get(path)
+	if err != nil {
+		return nil, err
+	}
+	s.Lock()
+	defer s.Unlock()
+	if _, err := f.Seek(id.Offset, os.SEEK_SET); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(f)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	sp := strings.IndexByte(line, ' ')
+	if sp == -1 {
+		return nil, errors.New("malformed shard line")
+	}
+	return base64.StdEncoding.DecodeString(line[sp+1:])
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+)
+
+// MigrateFileStoreToStore copies every topic and post, which posts are
+// deleted, the blocked ip ranges and the display-name overrides from a
+// FileStore (the forum/<name>.txt + blobs/ tree) into dst, preserving
+// post ids, message sha1s and timestamps. Only the current deleted and
+// blocked state is copied, not the delete/undelete and block/unblock
+// records that led to it. dst is expected to
+// be a freshly created, empty Store: topic and post ids are assigned by
+// dst itself as posts are written, in the same order they appear in
+// src, so a non-empty dst would end up with posts attached to whichever
+// topics happen to already occupy those ids.
+func MigrateFileStoreToStore(src *FileStore, dst Store) error {
+	nTopics, nPosts := 0, 0
+	for i := range src.topics {
+		srcTopic := &src.topics[i]
+		var dstTopicID int
+		for j := range srcTopic.Posts {
+			p := &srcTopic.Posts[j]
+			msg, err := src.GetMessage(p.MessageSha1)
+			if err != nil {
+				return fmt.Errorf("migrate: failed to read message for post %d/%d: %w", srcTopic.Id, p.Id, err)
+			}
+			var migrateErr error
+			if j == 0 {
+				dstTopicID, migrateErr = dst.CreateNewPost(srcTopic.Subject, string(msg), p.UserNameInternal, p.IpAddress())
+				nTopics++
+			} else {
+				migrateErr = dst.AddPostToTopic(dstTopicID, string(msg), p.UserNameInternal, p.IpAddress())
+			}
+			if migrateErr != nil {
+				return fmt.Errorf("migrate: failed to write post %d/%d: %w", srcTopic.Id, p.Id, migrateErr)
+			}
+			if err := dst.SetPostCreatedOn(dstTopicID, p.Id, p.CreatedOn); err != nil {
+				return fmt.Errorf("migrate: failed to set timestamp for post %d/%d: %w", srcTopic.Id, p.Id, err)
+			}
+			if p.IsDeleted {
+				if err := dst.DeletePost(dstTopicID, p.Id); err != nil {
+					return fmt.Errorf("migrate: failed to mark post %d/%d deleted: %w", srcTopic.Id, p.Id, err)
+				}
+			}
+			nPosts++
+		}
+	}
+	for _, prefix := range src.blockedIPAddresses {
+		if err := dst.BlockCIDR(prefix.String()); err != nil {
+			return fmt.Errorf("migrate: failed to block %s: %w", prefix, err)
+		}
+	}
+	for userNameInternal, displayName := range src.displayNameOverrides {
+		if err := dst.SetDisplayNameOverride(userNameInternal, displayName); err != nil {
+			return fmt.Errorf("migrate: failed to set display name override for %s: %w", userNameInternal, err)
+		}
+	}
+	fmt.Printf("migrate: copied %d topics, %d posts, %d blocked ip ranges, %d display name overrides\n",
+		nTopics, nPosts, len(src.blockedIPAddresses), len(src.displayNameOverrides))
+	return nil
+}
+
+// RunMigrateCommand implements the `fofou migrate` subcommand: it parses
+// its own flag set out of args, opens the source FileStore and
+// destination SQLStore, and runs MigrateFileStoreToStore. There's no
+// main package in this snapshot for a "fofou migrate ..." command line
+// to dispatch to, but this is the function it would call.
+func RunMigrateCommand(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dataDir := fs.String("data-dir", "", "directory holding forum/<name>.txt and blobs/")
+	forumName := fs.String("forum", "", "forum name, i.e. the <name> in forum/<name>.txt")
+	dstDriver := fs.String("dst-driver", "sqlite3", "database/sql driver name for the destination store")
+	dstDSN := fs.String("dst-dsn", "", "database/sql data source name for the destination store")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *dataDir == "" || *forumName == "" || *dstDSN == "" {
+		return errors.New("migrate: -data-dir, -forum and -dst-dsn are required")
+	}
+
+	src, err := NewFileStore(*dataDir, *forumName)
+	if err != nil {
+		return fmt.Errorf("migrate: failed to open source FileStore: %w", err)
+	}
+	defer src.Close()
+
+	dst, err := NewSQLStore(*dstDriver, *dstDSN)
+	if err != nil {
+		return fmt.Errorf("migrate: failed to open destination SQLStore: %w", err)
+	}
+	defer dst.Close()
+
+	return MigrateFileStoreToStore(src, dst)
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// searchStopwords are dropped during tokenization; they're common
+// enough to be useless as search terms and just bloat the index.
+var searchStopwords = map[string]bool{
+	"a": true, "an": true, "the": true, "is": true, "are": true, "was": true,
+	"were": true, "be": true, "been": true, "to": true, "of": true, "and": true,
+	"or": true, "in": true, "on": true, "at": true, "for": true, "with": true,
+	"it": true, "this": true, "that": true, "as": true, "by": true,
+}
+
+// tokenize lowercases s, splits on anything that isn't a letter or
+// digit, and drops stopwords.
+func tokenize(s string) []string {
+	s = strings.ToLower(s)
+	var tokens []string
+	var cur strings.Builder
+	flush := func() {
+		if cur.Len() == 0 {
+			return
+		}
+		tok := cur.String()
+		cur.Reset()
+		if !searchStopwords[tok] {
+			tokens = append(tokens, tok)
+		}
+	}
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			cur.WriteRune(r)
+		} else {
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+// docKey identifies a post in the search index
+type docKey struct {
+	TopicID int
+	PostID  int
+}
+
+// searchDoc is what the index keeps per indexed post: enough to apply
+// user:/topic: filters and detect quoted phrases without re-fetching
+// the message body.
+type searchDoc struct {
+	userName  string
+	positions map[string][]int // term -> ascending token positions
+}
+
+// searchIndex is an in-memory inverted index of tokens -> postings,
+// shared by both Store backends. Term frequency (not just a raw match
+// count) is kept per posting so Search can do simple BM25-ish scoring.
+type searchIndex struct {
+	sync.Mutex
+	postings map[string]map[docKey]int // term -> docKey -> term frequency
+	docs     map[docKey]*searchDoc
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		postings: make(map[string]map[docKey]int),
+		docs:     make(map[docKey]*searchDoc),
+	}
+}
+
+// addDoc (re)indexes a post's message body, replacing any previous
+// entry for the same key.
+func (idx *searchIndex) addDoc(key docKey, userName, text string) {
+	idx.Lock()
+	defer idx.Unlock()
+	idx.removeDocLocked(key)
+
+	tokens := tokenize(text)
+	positions := make(map[string][]int, len(tokens))
+	for pos, tok := range tokens {
+		positions[tok] = append(positions[tok], pos)
+	}
+	idx.docs[key] = &searchDoc{userName: userName, positions: positions}
+	for term, pos := range positions {
+		m, ok := idx.postings[term]
+		if !ok {
+			m = make(map[docKey]int)
+			idx.postings[term] = m
+		}
+		m[key] = len(pos)
+	}
+}
+
+// removeDoc drops a post from the index, e.g. when it's deleted.
+func (idx *searchIndex) removeDoc(key docKey) {
+	idx.Lock()
+	defer idx.Unlock()
+	idx.removeDocLocked(key)
+}
+
+func (idx *searchIndex) removeDocLocked(key docKey) {
+	doc, ok := idx.docs[key]
+	if !ok {
+		return
+	}
+	for term := range doc.positions {
+		delete(idx.postings[term], key)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+	delete(idx.docs, key)
+}
+
+// parsedSearchQuery is the result of splitting a query string into its
+// AND terms, quoted phrases, and user:/topic: filters.
+type parsedSearchQuery struct {
+	terms    []string
+	phrases  [][]string
+	user     string
+	topicID  int
+	hasTopic bool
+}
+
+func parseSearchQuery(q string) parsedSearchQuery {
+	var pq parsedSearchQuery
+	for i := 0; i < len(q); {
+		for i < len(q) && q[i] == ' ' {
+			i++
+		}
+		if i >= len(q) {
+			break
+		}
+		if q[i] == '"' {
+			rest := q[i+1:]
+			end := strings.IndexByte(rest, '"')
+			var phrase string
+			if end == -1 {
+				phrase = rest
+				i = len(q)
+			} else {
+				phrase = rest[:end]
+				i += 1 + end + 1
+			}
+			if toks := tokenize(phrase); len(toks) > 0 {
+				pq.phrases = append(pq.phrases, toks)
+			}
+			continue
+		}
+		end := strings.IndexByte(q[i:], ' ')
+		var word string
+		if end == -1 {
+			word = q[i:]
+			i = len(q)
+		} else {
+			word = q[i : i+end]
+			i += end
+		}
+		switch {
+		case strings.HasPrefix(word, "user:"):
+			pq.user = strings.ToLower(word[len("user:"):])
+		case strings.HasPrefix(word, "topic:"):
+			if id, err := strconv.Atoi(word[len("topic:"):]); err == nil {
+				pq.topicID = id
+				pq.hasTopic = true
+			}
+		default:
+			pq.terms = append(pq.terms, tokenize(word)...)
+		}
+	}
+	return pq
+}
+
+func phraseMatches(doc *searchDoc, phrase []string) bool {
+	if len(phrase) == 0 {
+		return true
+	}
+	for _, start := range doc.positions[phrase[0]] {
+		matched := true
+		for i := 1; i < len(phrase); i++ {
+			if !containsInt(doc.positions[phrase[i]], start+i) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(positions []int, v int) bool {
+	// each slice is one term's occurrences within a single doc, so this
+	// is always tiny; a linear scan beats building an index of an index
+	for _, p := range positions {
+		if p == v {
+			return true
+		}
+	}
+	return false
+}
+
+// query runs q (AND terms, quoted phrases, user:/topic: filters)
+// against the index, returning up to max matches ranked by a simple
+// BM25-ish score (highest first) along with the total match count.
+func (idx *searchIndex) query(q string, max int) ([]docKey, int) {
+	pq := parseSearchQuery(q)
+
+	idx.Lock()
+	defer idx.Unlock()
+
+	allTerms := make([]string, 0, len(pq.terms))
+	allTerms = append(allTerms, pq.terms...)
+	for _, phrase := range pq.phrases {
+		allTerms = append(allTerms, phrase...)
+	}
+
+	if len(allTerms) == 0 && pq.user == "" && !pq.hasTopic {
+		return nil, 0
+	}
+
+	var candidates map[docKey]bool
+	if len(allTerms) > 0 {
+		for i, term := range allTerms {
+			m := idx.postings[term]
+			if i == 0 {
+				candidates = make(map[docKey]bool, len(m))
+				for k := range m {
+					candidates[k] = true
+				}
+				continue
+			}
+			for k := range candidates {
+				if _, ok := m[k]; !ok {
+					delete(candidates, k)
+				}
+			}
+		}
+	} else {
+		candidates = make(map[docKey]bool, len(idx.docs))
+		for k := range idx.docs {
+			candidates[k] = true
+		}
+	}
+
+	type scoredDoc struct {
+		key   docKey
+		score float64
+	}
+	results := make([]scoredDoc, 0, len(candidates))
+	for key := range candidates {
+		doc := idx.docs[key]
+		if pq.user != "" && strings.ToLower(doc.userName) != pq.user {
+			continue
+		}
+		if pq.hasTopic && key.TopicID != pq.topicID {
+			continue
+		}
+		phraseOK := true
+		for _, phrase := range pq.phrases {
+			if !phraseMatches(doc, phrase) {
+				phraseOK = false
+				break
+			}
+		}
+		if !phraseOK {
+			continue
+		}
+		score := 0.0
+		for _, term := range allTerms {
+			if tf := len(doc.positions[term]); tf > 0 {
+				score += 1 + math.Log(float64(tf))
+			}
+		}
+		results = append(results, scoredDoc{key, score})
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].score > results[j].score })
+	total := len(results)
+	if max < len(results) {
+		results = results[:max]
+	}
+	keys := make([]docKey, len(results))
+	for i, r := range results {
+		keys[i] = r.key
+	}
+	return keys, total
+}
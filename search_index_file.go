@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/kjk/u"
+)
+
+// The on-disk search index (dataDir/forum/<name>.idx) is its own tiny
+// append-only log, separate from the main data file: a header line
+// recording the main data file's size as of the last full rebuild,
+// followed by one "S" line per post indexed at rebuild time, and then
+// one "A" (add/update) or "D" (remove) line per change made since,
+// appended as posts are created, deleted or undeleted. On startup we
+// just replay this log instead of re-tokenizing every message.
+const searchIndexExt = ".idx"
+
+func searchIndexPath(dataDir, forumName string) string {
+	return filepath.Join(dataDir, "forum", forumName+searchIndexExt)
+}
+
+func encodeDocLine(prefix byte, key docKey, userName string, tokens []string) string {
+	return fmt.Sprintf("%c%d|%d|%s|%s\n", prefix, key.TopicID, key.PostID, remSep(userName), strings.Join(tokens, " "))
+}
+
+func encodeRemoveLine(key docKey) string {
+	return fmt.Sprintf("D%d|%d\n", key.TopicID, key.PostID)
+}
+
+func decodeDocLine(line string) (docKey, string, []string, error) {
+	parts := strings.SplitN(line[1:], "|", 4)
+	if len(parts) != 4 {
+		return docKey{}, "", nil, errors.New("malformed search index line")
+	}
+	topicID, err1 := strconv.Atoi(parts[0])
+	postID, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		return docKey{}, "", nil, errors.New("malformed search index line")
+	}
+	var tokens []string
+	if parts[3] != "" {
+		tokens = strings.Split(parts[3], " ")
+	}
+	return docKey{TopicID: topicID, PostID: postID}, parts[2], tokens, nil
+}
+
+func decodeRemoveLine(line string) (docKey, error) {
+	parts := strings.Split(line[1:], "|")
+	if len(parts) != 2 {
+		return docKey{}, errors.New("malformed search index line")
+	}
+	topicID, err1 := strconv.Atoi(parts[0])
+	postID, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil {
+		return docKey{}, errors.New("malformed search index line")
+	}
+	return docKey{TopicID: topicID, PostID: postID}, nil
+}
+
+// buildOrLoadSearchIndex loads the persisted index if it's still valid
+// for the current data file, otherwise rebuilds it from scratch from
+// store.topics (which must already be populated).
+func (store *FileStore) buildOrLoadSearchIndex() error {
+	mainPath := filepath.Join(store.dataDir, "forum", store.forumName+".txt")
+	info, err := os.Stat(mainPath)
+	if err != nil {
+		return err
+	}
+
+	idxPath := searchIndexPath(store.dataDir, store.forumName)
+	loaded := false
+	if u.PathExists(idxPath) {
+		idx, err := loadSearchIndexFile(idxPath, info.Size())
+		if err != nil {
+			fmt.Printf("buildOrLoadSearchIndex: discarding stale index: %s\n", err)
+		} else {
+			store.search = idx
+			loaded = true
+		}
+	}
+	if !loaded {
+		if err := store.rebuildSearchIndex(idxPath, info.Size()); err != nil {
+			return err
+		}
+	}
+
+	store.idxFile, err = os.OpenFile(idxPath, os.O_APPEND|os.O_RDWR, 0666)
+	return err
+}
+
+func loadSearchIndexFile(path string, mainSize int64) (*searchIndex, error) {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimRight(string(d), "\n"), "\n")
+	if len(lines) == 0 || len(lines[0]) == 0 || lines[0][0] != 'O' {
+		return nil, errors.New("missing header")
+	}
+	offset, err := strconv.ParseInt(lines[0][1:], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bad header: %w", err)
+	}
+	if offset > mainSize {
+		return nil, errors.New("index refers to data beyond the current data file")
+	}
+
+	idx := newSearchIndex()
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+		switch line[0] {
+		case 'S', 'A':
+			key, userName, tokens, err := decodeDocLine(line)
+			if err != nil {
+				continue
+			}
+			idx.addDoc(key, userName, strings.Join(tokens, " "))
+		case 'D':
+			key, err := decodeRemoveLine(line)
+			if err != nil {
+				continue
+			}
+			idx.removeDoc(key)
+		}
+	}
+	return idx, nil
+}
+
+func (store *FileStore) rebuildSearchIndex(idxPath string, mainSize int64) error {
+	store.search = newSearchIndex()
+	f, err := os.Create(idxPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintf(f, "O%d\n", mainSize); err != nil {
+		return err
+	}
+	for i := range store.topics {
+		t := &store.topics[i]
+		for j := range t.Posts {
+			p := &t.Posts[j]
+			if p.IsDeleted {
+				continue
+			}
+			msg, err := store.GetMessage(p.MessageSha1)
+			if err != nil {
+				continue
+			}
+			key := docKey{TopicID: t.Id, PostID: p.Id}
+			store.search.addDoc(key, p.UserNameInternal, string(msg))
+			if _, err := f.WriteString(encodeDocLine('S', key, p.UserNameInternal, tokenize(string(msg)))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// indexNewPost adds a freshly-created post to the in-memory index and
+// persists the change.
+func (store *FileStore) indexNewPost(key docKey, userName string, msg []byte) {
+	tokens := tokenize(string(msg))
+	store.search.addDoc(key, userName, string(msg))
+	if store.idxFile == nil {
+		return
+	}
+	if _, err := store.idxFile.WriteString(encodeDocLine('A', key, userName, tokens)); err != nil {
+		logger.Errorf("FileStore.indexNewPost: failed to persist search index: %q\n", err)
+	}
+}
+
+// unindexPost drops a deleted post from the in-memory index and
+// persists the change.
+func (store *FileStore) unindexPost(key docKey) {
+	store.search.removeDoc(key)
+	if store.idxFile == nil {
+		return
+	}
+	if _, err := store.idxFile.WriteString(encodeRemoveLine(key)); err != nil {
+		logger.Errorf("FileStore.unindexPost: failed to persist search index: %q\n", err)
+	}
+}
+
+// Search runs a full-text query against post bodies
+func (store *FileStore) Search(query string, max int) ([]*Post, int) {
+	store.Lock()
+	defer store.Unlock()
+
+	keys, total := store.search.query(query, max)
+	res := make([]*Post, 0, len(keys))
+	for _, k := range keys {
+		t := store.topicByIDUnlocked(k.TopicID)
+		if t == nil || k.PostID > len(t.Posts) {
+			continue
+		}
+		res = append(res, &t.Posts[k.PostID-1])
+	}
+	return res, total
+}
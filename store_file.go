@@ -0,0 +1,1070 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kjk/u"
+)
+
+// FileStore is the original backend: an append-only text file of
+// records (topics, posts, delete/undelete markers, ip blocks) plus the
+// message bodies, kept in the date-sharded message store (see
+// message_store.go) or, for posts that predate it, a content-addressed
+// blobs/ directory. It's
+// simple and dependency-free, but every query that isn't "give me
+// everything" (e.g. GetPostsByUserInternal) is a linear scan, and
+// readExistingData() replays the whole history, in RAM, on every start.
+type FileStore struct {
+	sync.Mutex
+	dataDir   string
+	forumName string
+	topics    []Topic
+
+	// for some functions it's convenient to traverse the posts ordered by
+	// time, so we keep them ordered here, even though they are already stored
+	// as part of Topic in topics
+	posts []*Post
+
+	// CIDR ranges (and single addresses, stored as /32 or /128) that are
+	// blocked from posting
+	blockedIPAddresses []netip.Prefix
+	dataFile           *os.File
+
+	// messages is the date-sharded store backing posts created by this
+	// process; messageLocations lets GetMessage/MessageIDFor find a
+	// post's body by its sha1 without re-scanning the shards. midxFile
+	// persists that map so it survives a restart.
+	messages         *fileMessageStore
+	messageLocations map[[20]byte]fileMessageID
+	midxFile         *os.File
+
+	// search is the in-memory full-text index, persisted incrementally
+	// to idxFile
+	search  *searchIndex
+	idxFile *os.File
+
+	// displayNameOverrides holds this forum's display-name overrides
+	// (see SetDisplayNameOverride), persisted as N records. Scoped to
+	// this FileStore rather than process-wide, so two forums loaded in
+	// the same process don't collide.
+	displayNameOverrides map[string]string
+}
+
+// parse:
+// D|1234|1
+func parseDelUndel(d []byte) (int, int) {
+	s := string(d[1:])
+	parts := strings.Split(s, "|")
+	if len(parts) != 2 {
+		panic("len(parts) != 2")
+	}
+	topicID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		panic("invalid topicId")
+	}
+	postID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		panic("invalid postId")
+	}
+	return topicID, postID
+}
+
+func findPostToDelUndel(d []byte, topicIDToTopic map[int]*Topic) *Post {
+	topicID, postId := parseDelUndel(d)
+	topic, ok := topicIDToTopic[topicID]
+	if !ok {
+		panic("no topic with that id")
+	}
+	if postId > len(topic.Posts) {
+		panic("invalid postId")
+	}
+	return &topic.Posts[postId-1]
+}
+
+// parse:
+// T$id|$subject
+func parseTopic(line []byte) Topic {
+	s := string(line[1:])
+	parts := strings.Split(s, "|")
+	if len(parts) != 2 {
+		panic("len(parts) != 2")
+	}
+	subject := parts[1]
+	idStr := parts[0]
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		panic("idStr is not a number")
+	}
+	t := Topic{
+		Id:      id,
+		Subject: subject,
+		Posts:   make([]Post, 0),
+	}
+	return t
+}
+
+func intStrToBool(s string) bool {
+	if i, err := strconv.Atoi(s); err == nil {
+		if i == 0 {
+			return false
+		}
+		if i == 1 {
+			return true
+		}
+		panic("i is not 0 or 1")
+	}
+	panic("s is not an integer")
+}
+
+// parse:
+// B$prefix|$isBlocked - current format; $prefix is a CIDR like
+// "10.1.2.0/24" or a single address written as a /32 (v4) or /128 (v6)
+// prefix.
+// B$hexInternalAddr|$isBlocked - legacy format predating CIDR support;
+// $hexInternalAddr is upgraded to a single-address prefix.
+func parseBlockUnblockIPAddr(line []byte) (netip.Prefix, bool) {
+	s := string(line[1:])
+	parts := strings.Split(s, "|")
+	if len(parts) != 2 {
+		panic("len(parts) != 2")
+	}
+	blocked := intStrToBool(parts[1])
+	if prefix, err := netip.ParsePrefix(parts[0]); err == nil {
+		return prefix, blocked
+	}
+	addr, err := parseInternalIPAddr(parts[0])
+	if err != nil {
+		panic("invalid ip prefix or legacy internal address: " + parts[0])
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), blocked
+}
+
+// parse:
+// P1|1|1148874103|K4hYtOI8xYt5dYH25VQ7Qcbk73A|4b0af66e|Krzysztof Kowalczyk
+func parsePost(line []byte, topicIDToTopic map[int]*Topic) Post {
+	s := string(line[1:])
+	parts := strings.Split(s, "|")
+	if len(parts) != 6 {
+		panic("len(parts) != 6")
+	}
+	topicIDStr := parts[0]
+	idStr := parts[1]
+	createdOnSecondsStr := parts[2]
+	msgSha1b64 := parts[3] + "="
+	ipAddrInternal := parts[4]
+	userName := parts[5]
+
+	topicID, err := strconv.Atoi(topicIDStr)
+	if err != nil {
+		panic("topicIdStr not a number")
+	}
+
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		panic("idStr not a number")
+	}
+	createdOnSeconds, err := strconv.Atoi(createdOnSecondsStr)
+	if err != nil {
+		panic("createdOnSeconds not a number")
+	}
+	createdOn := time.Unix(int64(createdOnSeconds), 0)
+	msgSha1, err := base64.StdEncoding.DecodeString(msgSha1b64)
+	if err != nil {
+		panic("msgSha1b64 not valid base64")
+	}
+	if len(msgSha1) != 20 {
+		panic("len(msgSha1) != 20")
+	}
+	t, ok := topicIDToTopic[topicID]
+	if !ok {
+		panic("didn't find topic with a given topicId")
+	}
+	realPostID := len(t.Posts) + 1
+	if id != realPostID {
+		fmt.Printf("!Unexpected post id:\n")
+		fmt.Printf("  %s\n", string(line))
+		fmt.Printf("  id: %d, expectedId: %d, topicId: %d\n", topicID, id, realPostID)
+		fmt.Printf("  %s\n", t.Subject)
+		//TODO: I don't see how this could have happened, but it did, so
+		// silently ignore it
+		//panic("id != len(t.Posts) + 1")
+	}
+	post := Post{
+		Id:               realPostID,
+		CreatedOn:        createdOn,
+		UserNameInternal: userName,
+		IpAddrInternal:   ipAddrInternal,
+		IsDeleted:        false,
+		Topic:            t,
+	}
+	copy(post.MessageSha1[:], msgSha1)
+	return post
+}
+
+// parse:
+// W$topicId|$postId|$unixSeconds
+func parseCreatedOnOverride(line []byte) (topicID, postID int, createdOn time.Time) {
+	s := string(line[1:])
+	parts := strings.Split(s, "|")
+	if len(parts) != 3 {
+		panic("len(parts) != 3")
+	}
+	topicID, err := strconv.Atoi(parts[0])
+	if err != nil {
+		panic("invalid topicId")
+	}
+	postID, err = strconv.Atoi(parts[1])
+	if err != nil {
+		panic("invalid postId")
+	}
+	seconds, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		panic("invalid unix seconds")
+	}
+	return topicID, postID, time.Unix(seconds, 0)
+}
+
+// parse:
+// N$userNameInternal|$displayName
+func parseDisplayNameOverride(line []byte) (userNameInternal, displayName string) {
+	s := string(line[1:])
+	parts := strings.SplitN(s, "|", 2)
+	if len(parts) != 2 {
+		panic("len(parts) != 2")
+	}
+	return parts[0], parts[1]
+}
+
+func (store *FileStore) markIPBlockedOrUnblocked(prefix netip.Prefix, blocked bool) {
+	if blocked {
+		store.blockedIPAddresses = append(store.blockedIPAddresses, prefix)
+	} else {
+		deletePrefixIn(&store.blockedIPAddresses, prefix)
+	}
+}
+
+// a compacted data file (see Compact in store_compact.go) starts with a
+// "C<compactedLen>|<sha1hex>\n" header: compactedLen is the size of the
+// body Compact() wrote, and sha1hex is its checksum. We only ever
+// verify that first compactedLen bytes - anything beyond it is just
+// ordinary T/P/D/U/B/N records appended by normal use after the
+// compaction ran, and must not be folded into the checksum or every
+// post written since the last Compact() would make the whole file look
+// corrupt. Strip and verify the prefix here so a truly corrupted
+// compacted file is refused rather than silently misread.
+func stripCompactionHeader(d []byte) ([]byte, error) {
+	if len(d) == 0 || d[0] != 'C' {
+		return d, nil
+	}
+	idx := bytes.IndexByte(d, '\n')
+	if idx == -1 {
+		return nil, errors.New("truncated compaction checksum header")
+	}
+	header, rest := string(d[1:idx]), d[idx+1:]
+	parts := strings.SplitN(header, "|", 2)
+	if len(parts) != 2 {
+		return nil, errors.New("malformed compaction checksum header")
+	}
+	compactedLen, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || compactedLen < 0 || compactedLen > int64(len(rest)) {
+		return nil, errors.New("malformed compaction checksum header")
+	}
+	wantHex := parts[1]
+	got := u.Sha1OfBytes(rest[:compactedLen])
+	if hex.EncodeToString(got[:]) != wantHex {
+		return nil, fmt.Errorf("data file fails compaction checksum (got %s)", hex.EncodeToString(got[:]))
+	}
+	return rest, nil
+}
+
+func (store *FileStore) readExistingData(fileDataPath string) error {
+	d, err := ioutil.ReadFile(fileDataPath)
+	if err != nil {
+		return err
+	}
+	if d, err = stripCompactionHeader(d); err != nil {
+		return err
+	}
+
+	topicIDToTopic := make(map[int]*Topic)
+	for len(d) > 0 {
+		idx := bytes.IndexByte(d, '\n')
+		var line []byte
+		if -1 != idx {
+			line = d[:idx]
+			d = d[idx+1:]
+		} else {
+			line = d
+			d = nil
+		}
+		//fmt.Printf("%q len(topics)=%d\n", string(line), len(topics))
+		c := line[0]
+		// T - topic
+		// P - post
+		// D - delete post
+		// U - undelete post
+		// B - block/unblock ipaddr
+		// N - display name override
+		// W - override a post's CreatedOn
+		switch c {
+		case 'T':
+			t := parseTopic(line)
+			store.topics = append(store.topics, t)
+			topicIDToTopic[t.Id] = &store.topics[len(store.topics)-1]
+		case 'P':
+			post := parsePost(line, topicIDToTopic)
+			t := post.Topic
+			t.Posts = append(t.Posts, post)
+			store.posts = append(store.posts, &t.Posts[len(t.Posts)-1])
+		case 'D':
+			// D|1234|1
+			post := findPostToDelUndel(line, topicIDToTopic)
+			if post.IsDeleted {
+				//Note: sadly, it happens
+				//panic("post already deleted")
+			}
+			post.IsDeleted = true
+		case 'U':
+			// U|1234|1
+			post := findPostToDelUndel(line, topicIDToTopic)
+			if !post.IsDeleted {
+				panic("post already undeleted")
+			}
+			post.IsDeleted = false
+		case 'B':
+			// B$prefix|$isBlocked (or legacy B$hexInternalAddr|$isBlocked)
+			prefix, blocked := parseBlockUnblockIPAddr(line)
+			store.markIPBlockedOrUnblocked(prefix, blocked)
+		case 'W':
+			// W$topicId|$postId|$unixSeconds
+			topicID, postID, createdOn := parseCreatedOnOverride(line)
+			topic, ok := topicIDToTopic[topicID]
+			if !ok {
+				panic("no topic with that id")
+			}
+			if postID > len(topic.Posts) {
+				panic("invalid postId")
+			}
+			topic.Posts[postID-1].CreatedOn = createdOn
+		case 'N':
+			// N$userNameInternal|$displayName
+			userNameInternal, displayName := parseDisplayNameOverride(line)
+			store.displayNameOverrides[userNameInternal] = displayName
+		default:
+			panic("Unexpected line type")
+		}
+	}
+	return nil
+}
+
+func verifyTopics(topics []Topic) {
+	for i, t := range topics {
+		if 0 == len(t.Posts) {
+			fmt.Printf("topics at idx %d (%v) has no posts!\n", i, t)
+		}
+	}
+}
+
+// NewFileStore creates a new Store backed by an append-only text file
+// rooted at dataDir/forum/<forumName>.txt
+func NewFileStore(dataDir, forumName string) (*FileStore, error) {
+	dataFilePath := filepath.Join(dataDir, "forum", forumName+".txt")
+	store := &FileStore{
+		dataDir:              dataDir,
+		forumName:            forumName,
+		posts:                make([]*Post, 0),
+		topics:               make([]Topic, 0),
+		messages:             newFileMessageStore(fsMessageStoreMaxFiles),
+		messageLocations:     make(map[[20]byte]fileMessageID),
+		displayNameOverrides: make(map[string]string),
+	}
+	var err error
+	if u.PathExists(dataFilePath) {
+		if err = store.readExistingData(dataFilePath); err != nil {
+			fmt.Printf("readExistingData() failed with %s\n", err)
+			return nil, err
+		}
+	} else {
+		f, err := os.Create(dataFilePath)
+		if err != nil {
+			fmt.Printf("NewFileStore(): os.Create(%s) failed with %s\n", dataFilePath, err)
+			return nil, err
+		}
+		f.Close()
+	}
+
+	verifyTopics(store.topics)
+
+	store.dataFile, err = os.OpenFile(dataFilePath, os.O_APPEND|os.O_RDWR, 0666)
+	if err != nil {
+		fmt.Printf("NewFileStore(): os.OpenFile(%s) failed with %s", dataFilePath, err)
+		return nil, err
+	}
+
+	midxPath := filepath.Join(dataDir, "forum", forumName+".midx")
+	if err := store.readMessageIndex(midxPath); err != nil {
+		fmt.Printf("readMessageIndex() failed with %s\n", err)
+		return nil, err
+	}
+	store.midxFile, err = os.OpenFile(midxPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		fmt.Printf("NewFileStore(): os.OpenFile(%s) failed with %s", midxPath, err)
+		return nil, err
+	}
+
+	if err := store.buildOrLoadSearchIndex(); err != nil {
+		fmt.Printf("buildOrLoadSearchIndex() failed with %s\n", err)
+		return nil, err
+	}
+	return store, nil
+}
+
+// readMessageIndex loads the sha1 -> shard location map persisted in
+// dataDir/forum/<name>.midx, one "<sha1hex>|<topicID>|<yyyymmdd>|<offset>"
+// record per line. Missing file just means nothing has been written to
+// the sharded store yet.
+func (store *FileStore) readMessageIndex(path string) error {
+	if !u.PathExists(path) {
+		return nil
+	}
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(d), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		parts := strings.Split(line, "|")
+		if len(parts) != 4 {
+			continue
+		}
+		sha1Bytes, err := hex.DecodeString(parts[0])
+		if err != nil || len(sha1Bytes) != 20 {
+			continue
+		}
+		topicID, err1 := strconv.Atoi(parts[1])
+		offset, err2 := strconv.ParseInt(parts[3], 10, 64)
+		if err1 != nil || err2 != nil || len(parts[2]) != 8 {
+			continue
+		}
+		year, e1 := strconv.Atoi(parts[2][:4])
+		month, e2 := strconv.Atoi(parts[2][4:6])
+		day, e3 := strconv.Atoi(parts[2][6:8])
+		if e1 != nil || e2 != nil || e3 != nil {
+			continue
+		}
+		var sha1 [20]byte
+		copy(sha1[:], sha1Bytes)
+		store.messageLocations[sha1] = fileMessageID{
+			TopicID: topicID,
+			Date:    time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC),
+			Offset:  offset,
+		}
+	}
+	return nil
+}
+
+func (store *FileStore) recordMessageLocation(sha1 [20]byte, id fileMessageID) error {
+	store.messageLocations[sha1] = id
+	y, m, d := id.Date.Date()
+	line := fmt.Sprintf("%s|%d|%04d%02d%02d|%d\n", hex.EncodeToString(sha1[:]), id.TopicID, y, m, d, id.Offset)
+	_, err := store.midxFile.WriteString(line)
+	return err
+}
+
+// Close closes the underlying data file, message index and any open
+// shard file handles
+func (store *FileStore) Close() error {
+	store.Lock()
+	defer store.Unlock()
+	store.messages.closeAll()
+	if store.midxFile != nil {
+		store.midxFile.Close()
+	}
+	if store.idxFile != nil {
+		store.idxFile.Close()
+	}
+	return store.dataFile.Close()
+}
+
+// PostsCount returns number of posts
+func (store *FileStore) PostsCount() int {
+	store.Lock()
+	defer store.Unlock()
+	n := 0
+	for _, topic := range store.topics {
+		n += len(topic.Posts)
+	}
+	return n
+}
+
+// TopicsCount retuns number of topics
+func (store *FileStore) TopicsCount() int {
+	store.Lock()
+	defer store.Unlock()
+	return len(store.topics)
+}
+
+// GetTopics retuns topics
+func (store *FileStore) GetTopics(nMax, from int, withDeleted bool) ([]*Topic, int) {
+	res := make([]*Topic, 0, nMax)
+	store.Lock()
+	defer store.Unlock()
+	n := nMax
+	i := from
+	for n > 0 {
+		idx := len(store.topics) - 1 - i
+		if idx < 0 {
+			break
+		}
+		t := &store.topics[idx]
+		res = append(res, t)
+		n--
+		i++
+	}
+
+	newFrom := i
+	if len(store.topics)-1-newFrom <= 0 {
+		newFrom = 0
+	}
+	return res, newFrom
+}
+
+// note: could probably speed up with binary search, but given our sizes, we're
+// fast enough
+func (store *FileStore) topicByIDUnlocked(id int) *Topic {
+	for idx, t := range store.topics {
+		if id == t.Id {
+			return &store.topics[idx]
+		}
+	}
+	return nil
+}
+
+// TopicByID returns topic given its id
+func (store *FileStore) TopicByID(id int) *Topic {
+	store.Lock()
+	defer store.Unlock()
+	return store.topicByIDUnlocked(id)
+}
+
+func blobPath(dir, sha1 string) string {
+	d1 := sha1[:2]
+	d2 := sha1[2:4]
+	return filepath.Join(dir, "blobs", d1, d2, sha1)
+}
+
+// MessageFilePath returns the path of the legacy content-addressed blob
+// for sha1, if this message predates the sharded message store.
+func (store *FileStore) MessageFilePath(sha1 [20]byte) string {
+	sha1Str := hex.EncodeToString(sha1[:])
+	return blobPath(store.dataDir, sha1Str)
+}
+
+// GetMessage returns the raw message body for a post identified by the
+// sha1 of its content. Posts written since the sharded message store
+// was introduced are read from there; older posts fall back to the
+// legacy blobs/ directory.
+func (store *FileStore) GetMessage(sha1 [20]byte) ([]byte, error) {
+	store.Lock()
+	defer store.Unlock()
+	return store.getMessageUnlocked(sha1)
+}
+
+// getMessageUnlocked is GetMessage without taking store.Lock(), for
+// callers (UndeletePost) that already hold it; recordMessageLocation
+// writes messageLocations under the same lock, so reading it here
+// without holding the lock would race.
+func (store *FileStore) getMessageUnlocked(sha1 [20]byte) ([]byte, error) {
+	if id, ok := store.messageLocations[sha1]; ok {
+		return store.messages.readMessage(store.dataDir, store.forumName, id)
+	}
+	return ioutil.ReadFile(store.MessageFilePath(sha1))
+}
+
+// MessageIDFor returns a stable, opaque identifier for a post's
+// message. For posts written to the sharded message store this encodes
+// their shard location; for older posts it falls back to their sha1.
+func (store *FileStore) MessageIDFor(post *Post) string {
+	store.Lock()
+	defer store.Unlock()
+	if id, ok := store.messageLocations[post.MessageSha1]; ok {
+		return id.String()
+	}
+	return "s" + hex.EncodeToString(post.MessageSha1[:])
+}
+
+// LookupByMessageID resolves an id previously returned by MessageIDFor
+// back to the post it identifies.
+func (store *FileStore) LookupByMessageID(idStr string) (*Post, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	if strings.HasPrefix(idStr, "s") {
+		sha1Bytes, err := hex.DecodeString(idStr[1:])
+		if err != nil || len(sha1Bytes) != 20 {
+			return nil, errors.New("malformed message id")
+		}
+		var sha1 [20]byte
+		copy(sha1[:], sha1Bytes)
+		for _, p := range store.posts {
+			if p.MessageSha1 == sha1 {
+				return p, nil
+			}
+		}
+		return nil, errors.New("no post with this message id")
+	}
+
+	id, err := parseFileMessageID(idStr)
+	if err != nil {
+		return nil, err
+	}
+	topic := store.topicByIDUnlocked(id.TopicID)
+	if topic == nil {
+		return nil, errors.New("no post with this message id")
+	}
+	for i := range topic.Posts {
+		p := &topic.Posts[i]
+		if loc, ok := store.messageLocations[p.MessageSha1]; ok && loc == id {
+			return p, nil
+		}
+	}
+	return nil, errors.New("no post with this message id")
+}
+
+// GetPostsBetween returns the posts created in [start, end)
+func (store *FileStore) GetPostsBetween(start, end time.Time) []*Post {
+	store.Lock()
+	defer store.Unlock()
+
+	var res []*Post
+	for _, p := range store.posts {
+		if !p.CreatedOn.Before(start) && p.CreatedOn.Before(end) {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+func (store *FileStore) findPost(topicID, postID int) (*Post, error) {
+	topic := store.topicByIDUnlocked(topicID)
+	if nil == topic {
+		return nil, errors.New("didn't find a topic with this id")
+	}
+	if postID > len(topic.Posts) {
+		return nil, errors.New("didn't find post with this id")
+	}
+
+	return &topic.Posts[postID-1], nil
+}
+
+func (store *FileStore) appendString(str string) error {
+	_, err := store.dataFile.WriteString(str)
+	if err != nil {
+		fmt.Printf("appendString() error: %s\n", err)
+	}
+	return err
+}
+
+// DeletePost deletes a post
+func (store *FileStore) DeletePost(topicID, postID int) error {
+	store.Lock()
+	defer store.Unlock()
+
+	post, err := store.findPost(topicID, postID)
+	if err != nil {
+		return err
+	}
+	if post.IsDeleted {
+		return errors.New("post already deleted")
+	}
+	str := fmt.Sprintf("D%d|%d\n", topicID, postID)
+	if err = store.appendString(str); err != nil {
+		return err
+	}
+	post.IsDeleted = true
+	store.unindexPost(docKey{TopicID: topicID, PostID: postID})
+	return nil
+}
+
+// UndeletePost undeletes a post
+func (store *FileStore) UndeletePost(topicID, postID int) error {
+	store.Lock()
+	defer store.Unlock()
+
+	post, err := store.findPost(topicID, postID)
+	if err != nil {
+		return err
+	}
+	if !post.IsDeleted {
+		return errors.New("post already not deleted")
+	}
+	str := fmt.Sprintf("U%d|%d\n", topicID, postID)
+	if err = store.appendString(str); err != nil {
+		return err
+	}
+	post.IsDeleted = false
+	if msg, err := store.getMessageUnlocked(post.MessageSha1); err == nil {
+		store.indexNewPost(docKey{TopicID: topicID, PostID: postID}, post.UserNameInternal, msg)
+	}
+	return nil
+}
+
+// ipAddrToInternal encodes ipAddr (v4 or v6) as the hex of its 16-byte
+// canonical form (v4 addresses use their IPv4-mapped form), so v4 and
+// v6 addresses share a single representation everywhere else in the
+// store. Invalid input is passed through unchanged rather than dropped,
+// so we never silently lose a caller-supplied string.
+func ipAddrToInternal(ipAddr string) string {
+	addr, err := netip.ParseAddr(ipAddr)
+	if err != nil {
+		return ipAddr
+	}
+	b := addr.As16()
+	return hex.EncodeToString(b[:])
+}
+
+// parseInternalIPAddr decodes the internal form produced by
+// ipAddrToInternal, including the legacy 7/8-hex-char (4-byte) ipv4
+// encodings used before this format existed.
+func parseInternalIPAddr(s string) (netip.Addr, error) {
+	// an earlier version of ipAddrToInternal would sometimes generate a
+	// 7-byte string (due to Printf() %x not printing the most
+	// significant byte as 0 padded); pad it back out
+	if len(s) == 7 {
+		s = "0" + s
+	}
+	if len(s) == 8 {
+		d, err := hex.DecodeString(s)
+		if err != nil || len(d) != 4 {
+			return netip.Addr{}, errors.New("bad legacy ipv4 internal address")
+		}
+		return netip.AddrFrom4([4]byte{d[0], d[1], d[2], d[3]}), nil
+	}
+	if len(s) == 32 {
+		d, err := hex.DecodeString(s)
+		if err != nil || len(d) != 16 {
+			return netip.Addr{}, errors.New("bad internal address")
+		}
+		var b16 [16]byte
+		copy(b16[:], d)
+		addr := netip.AddrFrom16(b16)
+		if addr.Is4In6() {
+			return addr.Unmap(), nil
+		}
+		return addr, nil
+	}
+	return netip.Addr{}, errors.New("unrecognized internal address encoding")
+}
+
+func ipAddrInternalToOriginal(s string) string {
+	addr, err := parseInternalIPAddr(s)
+	if err != nil {
+		// not an address we recognize; return as-is rather than lose it
+		return s
+	}
+	return addr.String()
+}
+
+func remSep(s string) string {
+	return strings.Replace(s, "|", "", -1)
+}
+
+func (store *FileStore) blockOrUnblockPrefix(prefix netip.Prefix, blocked bool) error {
+	prefix = prefix.Masked()
+	s := fmt.Sprintf("B%s|%d\n", prefix.String(), boolToInt(blocked))
+	if err := store.appendString(s); err != nil {
+		return err
+	}
+	store.markIPBlockedOrUnblocked(prefix, blocked)
+	return nil
+}
+
+func (store *FileStore) addNewPost(msg, user, ipAddr string, topic *Topic, newTopic bool) error {
+	msgBytes := []byte(msg)
+	sha1 := u.Sha1OfBytes(msgBytes)
+	p := &Post{
+		Id:               len(topic.Posts) + 1,
+		CreatedOn:        time.Now(),
+		UserNameInternal: remSep(user),
+		IpAddrInternal:   remSep(ipAddrToInternal(ipAddr)),
+		IsDeleted:        false,
+		Topic:            topic,
+	}
+	copy(p.MessageSha1[:], sha1)
+	msgID, err := store.messages.writeMessage(store.dataDir, store.forumName, topic.Id, msgBytes)
+	if err != nil {
+		logger.Errorf("FileStore.addNewPost: writeMessage failed with %q\n", err)
+		return err
+	}
+	if err := store.recordMessageLocation(p.MessageSha1, msgID); err != nil {
+		logger.Errorf("FileStore.addNewPost: recordMessageLocation failed with %q\n", err)
+		return err
+	}
+
+	topicStr := ""
+	if newTopic {
+		topicStr = fmt.Sprintf("T%d|%s\n", topic.Id, topic.Subject)
+	}
+
+	s1 := fmt.Sprintf("%d", p.CreatedOn.Unix())
+	s2 := base64.StdEncoding.EncodeToString(p.MessageSha1[:])
+	s2 = s2[:len(s2)-1] // remove unnecessary '=' from the end
+	s3 := p.UserNameInternal
+	sIP := p.IpAddrInternal
+	postStr := fmt.Sprintf("P%d|%d|%s|%s|%s|%s\n", topic.Id, p.Id, s1, s2, sIP, s3)
+	str := topicStr + postStr
+	if err := store.appendString(str); err != nil {
+		return err
+	}
+	store.indexNewPost(docKey{TopicID: topic.Id, PostID: p.Id}, p.UserNameInternal, msgBytes)
+	topic.Posts = append(topic.Posts, *p)
+	if newTopic {
+		store.topics = append(store.topics, *topic)
+	}
+	store.posts = append(store.posts, &topic.Posts[len(topic.Posts)-1])
+	return nil
+}
+
+// CreateNewPost creates a new post
+func (store *FileStore) CreateNewPost(subject, msg, user, ipAddr string) (int, error) {
+	store.Lock()
+	defer store.Unlock()
+
+	topic := &Topic{
+		Id:      1,
+		Subject: remSep(subject),
+		Posts:   make([]Post, 0),
+	}
+	if len(store.topics) > 0 {
+		// Id of the last topic + 1
+		topic.Id = store.topics[len(store.topics)-1].Id + 1
+	}
+	err := store.addNewPost(msg, user, ipAddr, topic, true)
+	return topic.Id, err
+}
+
+// AddPostToTopic adds a post to a topic
+func (store *FileStore) AddPostToTopic(topicID int, msg, user, ipAddr string) error {
+	store.Lock()
+	defer store.Unlock()
+
+	topic := store.topicByIDUnlocked(topicID)
+	if topic == nil {
+		return errors.New("invalid topicID")
+	}
+	return store.addNewPost(msg, user, ipAddr, topic, false)
+}
+
+// BlockIP blocks a single ip address, as a /32 (v4) or /128 (v6) prefix
+func (store *FileStore) BlockIP(ipAddr string) {
+	addr, err := netip.ParseAddr(ipAddr)
+	if err != nil {
+		return
+	}
+	store.Lock()
+	defer store.Unlock()
+	store.blockOrUnblockPrefix(netip.PrefixFrom(addr, addr.BitLen()), true)
+}
+
+// UnblockIP removes a block on a single ip address
+func (store *FileStore) UnblockIP(ipAddr string) {
+	addr, err := netip.ParseAddr(ipAddr)
+	if err != nil {
+		return
+	}
+	store.Lock()
+	defer store.Unlock()
+	store.blockOrUnblockPrefix(netip.PrefixFrom(addr, addr.BitLen()), false)
+}
+
+// BlockCIDR blocks a whole CIDR range (e.g. a /24 or /64) from posting
+func (store *FileStore) BlockCIDR(prefix string) error {
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR %q: %w", prefix, err)
+	}
+	store.Lock()
+	defer store.Unlock()
+	return store.blockOrUnblockPrefix(p, true)
+}
+
+// UnblockCIDR removes a block on a CIDR range
+func (store *FileStore) UnblockCIDR(prefix string) error {
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR %q: %w", prefix, err)
+	}
+	store.Lock()
+	defer store.Unlock()
+	return store.blockOrUnblockPrefix(p, false)
+}
+
+// IsIPBlocked checks if ipAddrInternal falls within a blocked range,
+// via longest-prefix match against the blocklist
+func (store *FileStore) IsIPBlocked(ipAddrInternal string) bool {
+	addr, err := parseInternalIPAddr(ipAddrInternal)
+	if err != nil {
+		return false
+	}
+	store.Lock()
+	defer store.Unlock()
+	for _, p := range store.blockedIPAddresses {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// SetPostCreatedOn overrides a post's recorded creation time,
+// persisting the change as a W record.
+func (store *FileStore) SetPostCreatedOn(topicID, postID int, createdOn time.Time) error {
+	store.Lock()
+	defer store.Unlock()
+	post, err := store.findPost(topicID, postID)
+	if err != nil {
+		return err
+	}
+	str := fmt.Sprintf("W%d|%d|%d\n", topicID, postID, createdOn.Unix())
+	if err := store.appendString(str); err != nil {
+		return err
+	}
+	post.CreatedOn = createdOn
+	return nil
+}
+
+// SetDisplayNameOverride permanently overrides the display name shown
+// for userNameInternal, persisting it as an N record. This replaces the
+// old hardcoded "t:kjk" -> "Krzysztof Kowalczyk" special case in
+// Post.UserName: call it once per user who needs one instead of adding
+// another case to that method.
+func (store *FileStore) SetDisplayNameOverride(userNameInternal, displayName string) error {
+	store.Lock()
+	defer store.Unlock()
+	str := fmt.Sprintf("N%s|%s\n", remSep(userNameInternal), remSep(displayName))
+	if err := store.appendString(str); err != nil {
+		return err
+	}
+	store.displayNameOverrides[userNameInternal] = displayName
+	return nil
+}
+
+// DisplayNameOverride looks up an override previously set by
+// SetDisplayNameOverride.
+func (store *FileStore) DisplayNameOverride(userNameInternal string) (string, bool) {
+	store.Lock()
+	defer store.Unlock()
+	name, ok := store.displayNameOverrides[userNameInternal]
+	return name, ok
+}
+
+// GetBlockedIpsCount returns number of blocked CIDR ranges
+func (store *FileStore) GetBlockedIpsCount() int {
+	store.Lock()
+	defer store.Unlock()
+	return len(store.blockedIPAddresses)
+}
+
+// GetRecentPosts returns recent posts
+func (store *FileStore) GetRecentPosts(max int) []*Post {
+	store.Lock()
+	defer store.Unlock()
+
+	// return the newest at the beginning of the returned array
+	if max > len(store.posts) {
+		max = len(store.posts)
+	}
+
+	res := make([]*Post, max, max)
+	for i := 0; i < max; i++ {
+		res[i] = store.posts[len(store.posts)-1-i]
+	}
+	return res
+}
+
+// GetPostsByUserInternal returns posts by user
+func (store *FileStore) GetPostsByUserInternal(userNameInternal string, max int) ([]*Post, int) {
+	store.Lock()
+	defer store.Unlock()
+
+	res := make([]*Post, 0)
+	total := 0
+	for i := len(store.posts) - 1; i >= 0; i-- {
+		p := store.posts[i]
+		if p.UserNameInternal == userNameInternal {
+			if total < max {
+				res = append(res, p)
+			}
+			total++
+		}
+	}
+	return res, total
+}
+
+// GetPostsByIPInternal returns posts from an ip address. Comparing via
+// parseInternalIPAddr rather than the raw string, same as
+// IsIPBlocked/GetPostsByIPPrefix, matters because posts loaded from a
+// data file written before ipAddrToInternal's current encoding keep
+// their original (e.g. legacy 7/8-hex-char) encoding forever - a plain
+// string compare against a freshly-encoded query address would silently
+// never match those.
+func (store *FileStore) GetPostsByIPInternal(ipAddrInternal string, max int) ([]*Post, int) {
+	queryAddr, err := parseInternalIPAddr(ipAddrInternal)
+	if err != nil {
+		return nil, 0
+	}
+
+	store.Lock()
+	defer store.Unlock()
+
+	res := make([]*Post, 0)
+	total := 0
+	for i := len(store.posts) - 1; i >= 0; i-- {
+		p := store.posts[i]
+		addr, err := parseInternalIPAddr(p.IpAddrInternal)
+		if err != nil || addr != queryAddr {
+			continue
+		}
+		if total < max {
+			res = append(res, p)
+		}
+		total++
+	}
+	return res, total
+}
+
+// GetPostsByIPPrefix returns posts made from any address within prefix,
+// e.g. to let a moderator see every post from a /24 they just blocked
+func (store *FileStore) GetPostsByIPPrefix(prefix netip.Prefix, max int) ([]*Post, int) {
+	store.Lock()
+	defer store.Unlock()
+
+	res := make([]*Post, 0)
+	total := 0
+	for i := len(store.posts) - 1; i >= 0; i-- {
+		p := store.posts[i]
+		addr, err := parseInternalIPAddr(p.IpAddrInternal)
+		if err != nil || !prefix.Contains(addr) {
+			continue
+		}
+		if total < max {
+			res = append(res, p)
+		}
+		total++
+	}
+	return res, total
+}
@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestIPAddrInternalRoundTrip(t *testing.T) {
+	tests := []string{
+		"127.0.0.1",
+		"10.1.2.3",
+		"::1",
+		"2001:db8::1",
+	}
+	for _, ipAddr := range tests {
+		internal := ipAddrToInternal(ipAddr)
+		addr, err := parseInternalIPAddr(internal)
+		if err != nil {
+			t.Fatalf("parseInternalIPAddr(%q) failed: %v", internal, err)
+		}
+		if addr.String() != ipAddr {
+			t.Fatalf("round trip of %q produced %q", ipAddr, addr.String())
+		}
+	}
+}
+
+func TestParseInternalIPAddrLegacyEncoding(t *testing.T) {
+	// the legacy encoder used %x on a uint32, so a first byte below 0x10
+	// lost its leading 0 digit, leaving a 7-char string instead of the
+	// usual 8
+	legacy7 := "15200a8"
+	legacy8 := "0" + legacy7
+
+	addr7, err := parseInternalIPAddr(legacy7)
+	if err != nil {
+		t.Fatalf("parseInternalIPAddr(%q) failed: %v", legacy7, err)
+	}
+	addr8, err := parseInternalIPAddr(legacy8)
+	if err != nil {
+		t.Fatalf("parseInternalIPAddr(%q) failed: %v", legacy8, err)
+	}
+	if addr7 != addr8 {
+		t.Fatalf("legacy 7-char and zero-padded 8-char encodings disagree: %v vs %v", addr7, addr8)
+	}
+}
+
+func TestGetPostsByIPInternalMatchesLegacyEncoding(t *testing.T) {
+	// regression test: a post loaded from a pre-upgrade data file keeps
+	// whatever legacy encoding parsePost read off disk, so looking it up
+	// by an address freshly run through today's ipAddrToInternal must
+	// still find it
+	store := &FileStore{
+		posts: make([]*Post, 0),
+	}
+	legacyInternal := "0a010203" // legacy 8-hex-char encoding of 10.1.2.3
+	p := &Post{Id: 1, IpAddrInternal: legacyInternal}
+	store.posts = append(store.posts, p)
+
+	queryInternal := ipAddrToInternal("10.1.2.3")
+	posts, total := store.GetPostsByIPInternal(queryInternal, 10)
+	if total != 1 || len(posts) != 1 || posts[0] != p {
+		t.Fatalf("GetPostsByIPInternal(%q) = %v, %d; want [%v], 1", queryInternal, posts, total, p)
+	}
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/kjk/u"
+)
+
+// schema in SQLite syntax (BLOB columns); it is used as is for every
+// driver, and Postgres, which has no BLOB type, does not accept it.
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS topics (
+	id      INTEGER PRIMARY KEY,
+	subject TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS posts (
+	topic_id            INTEGER NOT NULL,
+	id                  INTEGER NOT NULL,
+	created_on          INTEGER NOT NULL,
+	message_sha1        BLOB NOT NULL,
+	user_name_internal  TEXT NOT NULL,
+	ip_addr_internal    TEXT NOT NULL,
+	is_deleted          INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (topic_id, id)
+);
+CREATE INDEX IF NOT EXISTS idx_posts_user ON posts(user_name_internal);
+CREATE INDEX IF NOT EXISTS idx_posts_ip ON posts(ip_addr_internal);
+CREATE TABLE IF NOT EXISTS blocked_ips (
+	prefix  TEXT PRIMARY KEY,
+	blocked INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS display_name_overrides (
+	user_name_internal TEXT PRIMARY KEY,
+	display_name        TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS messages (
+	sha1 BLOB PRIMARY KEY,
+	body BLOB NOT NULL
+);
+`
+
+// SQLStore is a Store backed by database/sql. Its schema and queries are
+// written for SQLite (driverName "sqlite3"): BLOB columns, "?"
+// placeholders and INSERT OR IGNORE/REPLACE, none of which Postgres
+// accepts. Unlike FileStore it doesn't need a single in-process mutex:
+// reads are indexed queries and writes go through a transaction, so
+// concurrent access, including from several processes sharing one
+// database, is safe without us serializing every call.
+type SQLStore struct {
+	db *sql.DB
+}
+
+// NewSQLStore opens (creating if necessary) a SQL-backed store.
+func NewSQLStore(driverName, dataSourceName string) (*SQLStore, error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec(sqlSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("NewSQLStore: failed to create schema: %w", err)
+	}
+	return &SQLStore{db: db}, nil
+}
+
+// buildSearchIndex runs a fresh, uncached query over every non-deleted
+// post's body and builds an in-memory index from it, on the spot. An
+// index kept resident and updated only by this process's own writes
+// would go silently stale the moment there's more than one process
+// sharing the same database, so we pay the query cost on every Search()
+// instead of caching across calls.
+func (store *SQLStore) buildSearchIndex() (*searchIndex, error) {
+	idx := newSearchIndex()
+	rows, err := store.db.Query(`
+		SELECT p.topic_id, p.id, p.user_name_internal, m.body
+		FROM posts p JOIN messages m ON m.sha1 = p.message_sha1
+		WHERE p.is_deleted = 0`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var topicID, postID int
+		var userName string
+		var body []byte
+		if err := rows.Scan(&topicID, &postID, &userName, &body); err != nil {
+			return nil, err
+		}
+		idx.addDoc(docKey{TopicID: topicID, PostID: postID}, userName, string(body))
+	}
+	return idx, rows.Err()
+}
+
+// Close closes the underlying database connection
+func (store *SQLStore) Close() error {
+	return store.db.Close()
+}
+
+func (store *SQLStore) loadTopic(topicID int, withDeleted bool) (*Topic, error) {
+	t := &Topic{Id: topicID}
+	row := store.db.QueryRow(`SELECT subject FROM topics WHERE id = ?`, topicID)
+	if err := row.Scan(&t.Subject); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	rows, err := store.db.Query(`
+		SELECT id, created_on, message_sha1, user_name_internal, ip_addr_internal, is_deleted
+		FROM posts WHERE topic_id = ? ORDER BY id ASC`, topicID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		p, err := scanPost(rows, t)
+		if err != nil {
+			return nil, err
+		}
+		if !withDeleted && p.IsDeleted {
+			continue
+		}
+		t.Posts = append(t.Posts, *p)
+	}
+	return t, rows.Err()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPost(rows rowScanner, t *Topic) (*Post, error) {
+	var createdOnUnix int64
+	var sha1 []byte
+	var isDeleted int
+	p := &Post{Topic: t}
+	err := rows.Scan(&p.Id, &createdOnUnix, &sha1, &p.UserNameInternal, &p.IpAddrInternal, &isDeleted)
+	if err != nil {
+		return nil, err
+	}
+	p.CreatedOn = time.Unix(createdOnUnix, 0)
+	p.IsDeleted = isDeleted != 0
+	copy(p.MessageSha1[:], sha1)
+	return p, nil
+}
+
+// TopicByID returns topic given its id
+func (store *SQLStore) TopicByID(id int) *Topic {
+	t, err := store.loadTopic(id, true)
+	if err != nil || t == nil {
+		return nil
+	}
+	return t
+}
+
+// TopicsCount returns number of topics
+func (store *SQLStore) TopicsCount() int {
+	var n int
+	row := store.db.QueryRow(`SELECT COUNT(*) FROM topics`)
+	row.Scan(&n)
+	return n
+}
+
+// PostsCount returns number of posts
+func (store *SQLStore) PostsCount() int {
+	var n int
+	row := store.db.QueryRow(`SELECT COUNT(*) FROM posts`)
+	row.Scan(&n)
+	return n
+}
+
+// GetTopics returns at most nMax topics starting at from, newest first
+func (store *SQLStore) GetTopics(nMax, from int, withDeleted bool) ([]*Topic, int) {
+	rows, err := store.db.Query(`SELECT id FROM topics ORDER BY id DESC LIMIT ? OFFSET ?`, nMax, from)
+	if err != nil {
+		return nil, from
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	res := make([]*Topic, 0, len(ids))
+	for _, id := range ids {
+		if t, err := store.loadTopic(id, withDeleted); err == nil && t != nil {
+			res = append(res, t)
+		}
+	}
+	newFrom := from + len(ids)
+	if store.TopicsCount()-newFrom <= 0 {
+		newFrom = 0
+	}
+	return res, newFrom
+}
+
+// CreateNewPost creates a new topic with a single post in it, returning
+// the new topic's id
+func (store *SQLStore) CreateNewPost(subject, msg, user, ipAddr string) (int, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`INSERT INTO topics (id, subject) VALUES ((SELECT COALESCE(MAX(id), 0) + 1 FROM topics), ?)`, remSep(subject)); err != nil {
+		return 0, err
+	}
+	var topicID int
+	row := tx.QueryRow(`SELECT MAX(id) FROM topics`)
+	if err := row.Scan(&topicID); err != nil {
+		return 0, err
+	}
+	if err := insertPost(tx, topicID, 1, msg, user, ipAddr); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return topicID, nil
+}
+
+// AddPostToTopic adds a post to an existing topic
+func (store *SQLStore) AddPostToTopic(topicID int, msg, user, ipAddr string) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var n int
+	row := tx.QueryRow(`SELECT COUNT(*) FROM topics WHERE id = ?`, topicID)
+	if err := row.Scan(&n); err != nil {
+		return err
+	}
+	if n == 0 {
+		return errors.New("invalid topicID")
+	}
+	row = tx.QueryRow(`SELECT COALESCE(MAX(id), 0) + 1 FROM posts WHERE topic_id = ?`, topicID)
+	var postID int
+	if err := row.Scan(&postID); err != nil {
+		return err
+	}
+	if err := insertPost(tx, topicID, postID, msg, user, ipAddr); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertPost(tx *sql.Tx, topicID, postID int, msg, user, ipAddr string) error {
+	msgBytes := []byte(msg)
+	sha1 := u.Sha1OfBytes(msgBytes)
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO messages (sha1, body) VALUES (?, ?)`, sha1[:], msgBytes); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		INSERT INTO posts (topic_id, id, created_on, message_sha1, user_name_internal, ip_addr_internal, is_deleted)
+		VALUES (?, ?, ?, ?, ?, ?, 0)`,
+		topicID, postID, time.Now().Unix(), sha1[:], remSep(user), remSep(ipAddrToInternal(ipAddr)))
+	return err
+}
+
+// DeletePost marks a post as deleted
+func (store *SQLStore) DeletePost(topicID, postID int) error {
+	return store.setPostDeleted(topicID, postID, true)
+}
+
+// UndeletePost un-marks a post as deleted
+func (store *SQLStore) UndeletePost(topicID, postID int) error {
+	return store.setPostDeleted(topicID, postID, false)
+}
+
+func (store *SQLStore) setPostDeleted(topicID, postID int, deleted bool) error {
+	wantCurrent := boolToInt(!deleted)
+	res, err := store.db.Exec(`UPDATE posts SET is_deleted = ? WHERE topic_id = ? AND id = ? AND is_deleted = ?`,
+		boolToInt(deleted), topicID, postID, wantCurrent)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return fmt.Errorf("post %d/%d not found or already in the requested state", topicID, postID)
+	}
+	return nil
+}
+
+// SetPostCreatedOn overrides a post's recorded creation time; unlike
+// FileStore this is just an UPDATE, since rows here aren't append-only.
+func (store *SQLStore) SetPostCreatedOn(topicID, postID int, createdOn time.Time) error {
+	_, err := store.db.Exec(`UPDATE posts SET created_on = ? WHERE topic_id = ? AND id = ?`,
+		createdOn.Unix(), topicID, postID)
+	return err
+}
+
+// SetDisplayNameOverride permanently overrides the display name shown
+// for userNameInternal.
+func (store *SQLStore) SetDisplayNameOverride(userNameInternal, displayName string) error {
+	_, err := store.db.Exec(`INSERT OR REPLACE INTO display_name_overrides (user_name_internal, display_name) VALUES (?, ?)`,
+		userNameInternal, displayName)
+	return err
+}
+
+// DisplayNameOverride looks up an override previously set by
+// SetDisplayNameOverride. Queried fresh every call rather than cached,
+// same reasoning as buildSearchIndex: another process sharing the same
+// database may have set or changed it since we last looked.
+func (store *SQLStore) DisplayNameOverride(userNameInternal string) (string, bool) {
+	var displayName string
+	row := store.db.QueryRow(`SELECT display_name FROM display_name_overrides WHERE user_name_internal = ?`, userNameInternal)
+	if err := row.Scan(&displayName); err != nil {
+		return "", false
+	}
+	return displayName, true
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// BlockIP blocks a single ip address, as a /32 (v4) or /128 (v6) prefix
+func (store *SQLStore) BlockIP(ipAddr string) {
+	if addr, err := netip.ParseAddr(ipAddr); err == nil {
+		store.BlockCIDR(netip.PrefixFrom(addr, addr.BitLen()).String())
+	}
+}
+
+// UnblockIP removes a block on a single ip address
+func (store *SQLStore) UnblockIP(ipAddr string) {
+	if addr, err := netip.ParseAddr(ipAddr); err == nil {
+		store.UnblockCIDR(netip.PrefixFrom(addr, addr.BitLen()).String())
+	}
+}
+
+// BlockCIDR blocks a whole CIDR range (e.g. a /24 or /64) from posting
+func (store *SQLStore) BlockCIDR(prefix string) error {
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR %q: %w", prefix, err)
+	}
+	_, err = store.db.Exec(`INSERT OR REPLACE INTO blocked_ips (prefix, blocked) VALUES (?, 1)`, p.Masked().String())
+	return err
+}
+
+// UnblockCIDR removes a block on a CIDR range
+func (store *SQLStore) UnblockCIDR(prefix string) error {
+	p, err := netip.ParsePrefix(prefix)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR %q: %w", prefix, err)
+	}
+	_, err = store.db.Exec(`DELETE FROM blocked_ips WHERE prefix = ?`, p.Masked().String())
+	return err
+}
+
+// IsIPBlocked returns true if ipAddrInternal falls within a blocked
+// range. The blocklist is typically tiny, so we just walk it rather
+// than trying to do CIDR matching in SQL.
+func (store *SQLStore) IsIPBlocked(ipAddrInternal string) bool {
+	addr, err := parseInternalIPAddr(ipAddrInternal)
+	if err != nil {
+		return false
+	}
+	rows, err := store.db.Query(`SELECT prefix FROM blocked_ips WHERE blocked = 1`)
+	if err != nil {
+		return false
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s string
+		if rows.Scan(&s) != nil {
+			continue
+		}
+		if p, err := netip.ParsePrefix(s); err == nil && p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetBlockedIpsCount returns the number of blocked CIDR ranges
+func (store *SQLStore) GetBlockedIpsCount() int {
+	var n int
+	row := store.db.QueryRow(`SELECT COUNT(*) FROM blocked_ips WHERE blocked = 1`)
+	row.Scan(&n)
+	return n
+}
+
+// GetRecentPosts returns at most max most recent posts, newest first
+func (store *SQLStore) GetRecentPosts(max int) []*Post {
+	rows, err := store.db.Query(`
+		SELECT topic_id, id, created_on, message_sha1, user_name_internal, ip_addr_internal, is_deleted
+		FROM posts ORDER BY created_on DESC LIMIT ?`, max)
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	var res []*Post
+	for rows.Next() {
+		var topicID int
+		var createdOnUnix int64
+		var sha1 []byte
+		var isDeleted int
+		p := &Post{}
+		if err := rows.Scan(&topicID, &p.Id, &createdOnUnix, &sha1, &p.UserNameInternal, &p.IpAddrInternal, &isDeleted); err != nil {
+			continue
+		}
+		p.CreatedOn = time.Unix(createdOnUnix, 0)
+		p.IsDeleted = isDeleted != 0
+		copy(p.MessageSha1[:], sha1)
+		p.Topic = &Topic{Id: topicID}
+		res = append(res, p)
+	}
+	// like FileStore.GetRecentPosts, the query's DESC order puts the
+	// newest first
+	return res
+}
+
+// GetPostsByUserInternal returns posts made by a given (internal) user name
+func (store *SQLStore) GetPostsByUserInternal(userNameInternal string, max int) ([]*Post, int) {
+	return store.getPostsBy("user_name_internal", userNameInternal, max)
+}
+
+// GetPostsByIPInternal returns posts made from a given (internal) ip address
+func (store *SQLStore) GetPostsByIPInternal(ipAddrInternal string, max int) ([]*Post, int) {
+	return store.getPostsBy("ip_addr_internal", ipAddrInternal, max)
+}
+
+// GetPostsByIPPrefix returns posts made from any address within prefix.
+// There's no CIDR-aware index, so this scans; fine for an admin-facing
+// "show me everything from this range" query.
+func (store *SQLStore) GetPostsByIPPrefix(prefix netip.Prefix, max int) ([]*Post, int) {
+	rows, err := store.db.Query(`
+		SELECT topic_id, id, created_on, message_sha1, user_name_internal, ip_addr_internal, is_deleted
+		FROM posts ORDER BY created_on DESC`)
+	if err != nil {
+		return nil, 0
+	}
+	defer rows.Close()
+	res := make([]*Post, 0, max)
+	total := 0
+	for rows.Next() {
+		var topicID int
+		var createdOnUnix int64
+		var sha1 []byte
+		var isDeleted int
+		p := &Post{}
+		if err := rows.Scan(&topicID, &p.Id, &createdOnUnix, &sha1, &p.UserNameInternal, &p.IpAddrInternal, &isDeleted); err != nil {
+			continue
+		}
+		addr, err := parseInternalIPAddr(p.IpAddrInternal)
+		if err != nil || !prefix.Contains(addr) {
+			continue
+		}
+		p.CreatedOn = time.Unix(createdOnUnix, 0)
+		p.IsDeleted = isDeleted != 0
+		copy(p.MessageSha1[:], sha1)
+		p.Topic = &Topic{Id: topicID}
+		if total < max {
+			res = append(res, p)
+		}
+		total++
+	}
+	return res, total
+}
+
+func (store *SQLStore) getPostsBy(column, value string, max int) ([]*Post, int) {
+	var total int
+	row := store.db.QueryRow(fmt.Sprintf(`SELECT COUNT(*) FROM posts WHERE %s = ?`, column), value)
+	row.Scan(&total)
+
+	rows, err := store.db.Query(fmt.Sprintf(`
+		SELECT topic_id, id, created_on, message_sha1, user_name_internal, ip_addr_internal, is_deleted
+		FROM posts WHERE %s = ? ORDER BY created_on DESC LIMIT ?`, column), value, max)
+	if err != nil {
+		return nil, total
+	}
+	defer rows.Close()
+	res := make([]*Post, 0, max)
+	for rows.Next() {
+		var topicID int
+		var createdOnUnix int64
+		var sha1 []byte
+		var isDeleted int
+		p := &Post{}
+		if err := rows.Scan(&topicID, &p.Id, &createdOnUnix, &sha1, &p.UserNameInternal, &p.IpAddrInternal, &isDeleted); err != nil {
+			continue
+		}
+		p.CreatedOn = time.Unix(createdOnUnix, 0)
+		p.IsDeleted = isDeleted != 0
+		copy(p.MessageSha1[:], sha1)
+		p.Topic = &Topic{Id: topicID}
+		res = append(res, p)
+	}
+	return res, total
+}
+
+// GetMessage returns the raw message body for a post, identified by the
+// sha1 of its content
+func (store *SQLStore) GetMessage(sha1 [20]byte) ([]byte, error) {
+	var body []byte
+	row := store.db.QueryRow(`SELECT body FROM messages WHERE sha1 = ?`, sha1[:])
+	if err := row.Scan(&body); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errors.New("no message with this sha1")
+		}
+		return nil, err
+	}
+	return body, nil
+}
+
+// MessageIDFor returns a stable, opaque identifier for a post's
+// message. Rows are never renumbered in the DB, so topic_id/id is
+// already stable; we just encode it.
+func (store *SQLStore) MessageIDFor(post *Post) string {
+	return fmt.Sprintf("%d:%d", post.Topic.Id, post.Id)
+}
+
+// LookupByMessageID resolves an id previously returned by MessageIDFor
+// back to the post it identifies.
+func (store *SQLStore) LookupByMessageID(id string) (*Post, error) {
+	var topicID, postID int
+	if n, err := fmt.Sscanf(id, "%d:%d", &topicID, &postID); err != nil || n != 2 {
+		return nil, errors.New("malformed message id")
+	}
+	t, err := store.loadTopic(topicID, true)
+	if err != nil || t == nil {
+		return nil, errors.New("no post with this message id")
+	}
+	for i := range t.Posts {
+		if t.Posts[i].Id == postID {
+			return &t.Posts[i], nil
+		}
+	}
+	return nil, errors.New("no post with this message id")
+}
+
+// Search runs a full-text query against post bodies
+func (store *SQLStore) Search(query string, max int) ([]*Post, int) {
+	idx, err := store.buildSearchIndex()
+	if err != nil {
+		return nil, 0
+	}
+	keys, total := idx.query(query, max)
+	res := make([]*Post, 0, len(keys))
+	for _, k := range keys {
+		t, err := store.loadTopic(k.TopicID, true)
+		if err != nil || t == nil {
+			continue
+		}
+		for i := range t.Posts {
+			if t.Posts[i].Id == k.PostID {
+				res = append(res, &t.Posts[i])
+				break
+			}
+		}
+	}
+	return res, total
+}
+
+// Compact reclaims space left behind by deletes and updates. Unlike
+// FileStore, SQLStore never accumulates history beyond the current
+// state in the first place (UPDATE replaces rows in place rather than
+// appending), so this is just a VACUUM rather than a rewrite.
+func (store *SQLStore) Compact() error {
+	_, err := store.db.Exec(`VACUUM`)
+	return err
+}
+
+// GetPostsBetween returns the posts created in [start, end)
+func (store *SQLStore) GetPostsBetween(start, end time.Time) []*Post {
+	rows, err := store.db.Query(`
+		SELECT topic_id, id, created_on, message_sha1, user_name_internal, ip_addr_internal, is_deleted
+		FROM posts WHERE created_on >= ? AND created_on < ? ORDER BY created_on ASC`,
+		start.Unix(), end.Unix())
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	var res []*Post
+	for rows.Next() {
+		var topicID int
+		var createdOnUnix int64
+		var sha1 []byte
+		var isDeleted int
+		p := &Post{}
+		if err := rows.Scan(&topicID, &p.Id, &createdOnUnix, &sha1, &p.UserNameInternal, &p.IpAddrInternal, &isDeleted); err != nil {
+			continue
+		}
+		p.CreatedOn = time.Unix(createdOnUnix, 0)
+		p.IsDeleted = isDeleted != 0
+		copy(p.MessageSha1[:], sha1)
+		p.Topic = &Topic{Id: topicID}
+		res = append(res, p)
+	}
+	return res
+}